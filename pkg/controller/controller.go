@@ -1,23 +1,27 @@
 package controller
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
-	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
-	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/vvbogdanov87/acme-common/pkg/stack"
+	"github.com/vvbogdanov87/acme-common/pkg/update"
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -27,8 +31,46 @@ const (
 	conditionTypeReady = "Ready"
 
 	finalizerSuffix = ".cloud.acme.local/finalizer"
+
+	// ForceReconcileAnnotation, when set to "true" on an object, makes
+	// DefaultPredicates let an update event through even though the spec
+	// (generation) hasn't changed. Use it to force a reconcile, e.g. to
+	// retry after a failed Pulumi operation.
+	ForceReconcileAnnotation = "cloud.acme.local/force-reconcile"
+
+	// ForceDeleteAnnotation, when set to "true" on an object, makes
+	// Reconcile remove the finalizer despite a failed Destroy, recording
+	// the stack's remaining resource URNs to status for audit.
+	ForceDeleteAnnotation = "cloud.acme.local/force-delete"
 )
 
+// DefaultPredicates returns the predicate.Funcs controllers built on
+// Reconcile should pass to For/Owns in SetupWithManager. Adding the
+// finalizer and writing status both touch the object without changing its
+// spec, so combining predicate.GenerationChangedPredicate here keeps those
+// writes from re-enqueuing it and racing the in-flight Preview/Up (see the
+// update package doc for why that race matters). ForceReconcileAnnotation
+// is the escape hatch for callers that do need to force a reconcile
+// despite no spec change, and a deletion timestamp always lets the update
+// through since deleting an object with a finalizer doesn't bump its
+// generation.
+func DefaultPredicates() predicate.Funcs {
+	generationChanged := predicate.GenerationChangedPredicate{}
+
+	return predicate.Funcs{
+		CreateFunc:  func(event.CreateEvent) bool { return true },
+		DeleteFunc:  func(event.DeleteEvent) bool { return true },
+		GenericFunc: func(event.GenericEvent) bool { return true },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return generationChanged.Update(e) || forceReconcile(e.ObjectNew) || e.ObjectNew.GetDeletionTimestamp() != nil
+		},
+	}
+}
+
+func forceReconcile(o client.Object) bool {
+	return o.GetAnnotations()[ForceReconcileAnnotation] == "true"
+}
+
 // Obj interface extends the client.Object interface so we can handle the status of the Object
 type Obj interface {
 	client.Object
@@ -44,7 +86,162 @@ type Obj interface {
 	GetPulumiProgram() pulumi.RunFunc
 }
 
+// RemoteObj may be implemented alongside Obj by a custom resource whose
+// Pulumi program lives in a Git repository rather than being compiled into
+// the operator binary. When o also implements RemoteObj and GetGitSource
+// returns a non-nil source, Reconcile builds the stack from that source
+// instead of calling GetPulumiProgram.
+type RemoteObj interface {
+	Obj
+
+	// GetGitSource returns the Git repository the Pulumi program should be
+	// loaded from, or nil to fall back to GetPulumiProgram.
+	GetGitSource() *stack.GitSource
+}
+
+// SecretSinkObj may be implemented alongside Obj by a custom resource that
+// wants stack outputs Pulumi marks secret (auto.OutputValue.Secret) kept
+// out of its status. When o also implements SecretSinkObj and
+// GetSecretOutputSink returns non-nil, Reconcile writes those outputs into
+// that Secret instead, creating/updating it with an owner reference back
+// to o and removing it once o is finalized. Outputs that aren't marked
+// secret are still passed to SetStatus either way.
+type SecretSinkObj interface {
+	Obj
+
+	// GetSecretOutputSink returns the Secret secret stack outputs should be
+	// projected into, or nil for the default of passing every output,
+	// secret or not, to SetStatus.
+	GetSecretOutputSink() *corev1.SecretReference
+}
+
+// FinalizingStatus records progress and partial-failure detail for a
+// Destroy that hasn't completed cleanly yet.
+type FinalizingStatus struct {
+	// Attempts is the number of Destroy attempts made so far.
+	Attempts int
+
+	// LastError is the error from the most recent failed Destroy attempt.
+	LastError string
+
+	// OperationSummary mirrors the Pulumi operation result of the most
+	// recent attempt (resource counts by op type) so users can see what's
+	// pending without tailing logs.
+	OperationSummary map[apitype.OpType]int
+
+	// Log holds the Pulumi progress stream captured during the most recent
+	// attempt, so stuck teardowns can be diagnosed without kubectl-logs'ing
+	// the controller pod.
+	Log string
+
+	// OrphanedURNs records the stack's remaining resource URNs, captured
+	// when the finalizer was removed via ForceDeleteAnnotation despite a
+	// failed Destroy.
+	OrphanedURNs []string
+}
+
+// FinalizerStatusObj may be implemented alongside Obj by a custom resource
+// that wants Destroy attempt/partial-failure detail surfaced on its status
+// subresource. When o also implements FinalizerStatusObj, Reconcile calls
+// SetFinalizingStatus with the latest attempt on every failed Destroy, and
+// with nil once the stack is destroyed cleanly.
+type FinalizerStatusObj interface {
+	Obj
+
+	GetFinalizingStatus() *FinalizingStatus
+	SetFinalizingStatus(*FinalizingStatus)
+}
+
+// Controller runs s.Up/s.Destroy for reconciled objects via an
+// update.Manager; see that package's doc comment for why this doesn't
+// block the reconcile worker.
+type Controller struct {
+	updates *update.Manager
+
+	destroyAttemptsMu sync.Mutex
+	// destroyAttempts counts failed Destroy attempts per update.Key. It's
+	// tracked here rather than read back from FinalizerStatusObj so the
+	// exponential backoff works unconditionally, even for a CR that
+	// doesn't implement that optional status surface.
+	destroyAttempts map[update.Key]int
+
+	// DestroyBackoffBase and DestroyBackoffMax bound the exponential
+	// backoff used to requeue after a failed Destroy.
+	DestroyBackoffBase time.Duration
+	DestroyBackoffMax  time.Duration
+}
+
+// NewController creates a Controller with its own update.Manager and
+// default Destroy backoff (5s, doubling up to 5m).
+func NewController() *Controller {
+	return &Controller{
+		updates:            update.NewManager(),
+		destroyAttempts:    make(map[update.Key]int),
+		DestroyBackoffBase: 5 * time.Second,
+		DestroyBackoffMax:  5 * time.Minute,
+	}
+}
+
+// nextDestroyAttempt records and returns the (1-indexed) attempt count for
+// a failed Destroy against key.
+func (c *Controller) nextDestroyAttempt(key update.Key) int {
+	c.destroyAttemptsMu.Lock()
+	defer c.destroyAttemptsMu.Unlock()
+	c.destroyAttempts[key]++
+	return c.destroyAttempts[key]
+}
+
+// clearDestroyAttempts drops the recorded attempt count for key, e.g. once
+// the stack is destroyed or its finalizer is removed.
+func (c *Controller) clearDestroyAttempts(key update.Key) {
+	c.destroyAttemptsMu.Lock()
+	defer c.destroyAttemptsMu.Unlock()
+	delete(c.destroyAttempts, key)
+}
+
+// destroyBackoff returns the requeue delay for the given (1-indexed)
+// Destroy attempt count, doubling from DestroyBackoffBase and capped at
+// DestroyBackoffMax.
+func (c *Controller) destroyBackoff(attempts int) time.Duration {
+	backoff := c.DestroyBackoffBase
+	for i := 1; i < attempts; i++ {
+		if backoff >= c.DestroyBackoffMax {
+			return c.DestroyBackoffMax
+		}
+		backoff *= 2
+	}
+	if backoff > c.DestroyBackoffMax {
+		return c.DestroyBackoffMax
+	}
+	return backoff
+}
+
+// Events returns the channel of completed Updates. Wire it into
+// SetupWithManager, e.g.:
+//
+//	err = ctrl.NewControllerManagedBy(mgr).
+//		For(&v1.Foo{}).
+//		WatchesRawSource(source.Channel(c.Events(), &handler.EnqueueRequestForObject{})).
+//		Complete(reconciler)
+func (c *Controller) Events() <-chan event.GenericEvent {
+	return c.updates.Events()
+}
+
+var defaultController = NewController()
+
+// Reconcile is the package-level entry point most controllers call. It
+// delegates to a shared, package-wide Controller so every CR kind in an
+// operator binary reports Update completions on one channel; see Events.
 func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (ctrl.Result, error) {
+	return defaultController.Reconcile(ctx, o, req, r)
+}
+
+// Events returns the package-wide Controller's Update completion channel.
+func Events() <-chan event.GenericEvent {
+	return defaultController.Events()
+}
+
+func (c *Controller) Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 
 	// Fetch the Object instance
@@ -69,10 +266,18 @@ func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (c
 	}
 
 	kind := strings.ToLower(o.GetObjectKind().GroupVersionKind().Kind)
+	upKey := update.NewKey(kind, update.OperationUp, req.NamespacedName)
+	destroyKey := update.NewKey(kind, update.OperationDestroy, req.NamespacedName)
 
-	// Initialize the stack
-	program := o.GetPulumiProgram()
-	s, err := stack.GetStack(ctx, program, kind, o.GetName(), o.GetNamespace())
+	// Initialize the stack, either from a Git source or an inline program
+	// compiled into the operator binary.
+	var s *auto.Stack
+	var err error
+	if ro, ok := o.(RemoteObj); ok && ro.GetGitSource() != nil {
+		s, err = stack.GetRemoteStack(ctx, r, ro.GetGitSource(), kind, o.GetName(), o.GetNamespace())
+	} else {
+		s, err = stack.GetStack(ctx, r, o.GetPulumiProgram(), kind, o.GetName(), o.GetNamespace())
+	}
 	if err != nil {
 		log.Error(err, "failed to create stack")
 		return ctrl.Result{}, nil
@@ -83,12 +288,15 @@ func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (c
 	// Check if the Object instance is marked to be deleted, which is
 	// indicated by the deletion timestamp being set.
 	if o.GetDeletionTimestamp() == nil {
-		// Add a finalizer
+		// Add a finalizer. This is patched against the version we just
+		// fetched rather than folded into the spec-reconcile Update/Status
+		// calls below, so it doesn't race a concurrent spec edit.
 		if !controllerutil.ContainsFinalizer(o, finalizer) {
 			log.Info("Adding Finalizer for Object")
+			patch := client.MergeFromWithOptions(o.DeepCopyObject().(client.Object), client.MergeFromWithOptimisticLock{})
 			controllerutil.AddFinalizer(o, finalizer)
 
-			if err := r.Update(ctx, o); err != nil {
+			if err := r.Patch(ctx, o, patch); err != nil {
 				log.Error(err, "Failed to update custom resource to add finalizer")
 				return ctrl.Result{}, err
 			}
@@ -96,6 +304,85 @@ func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (c
 	} else {
 		// Delete the stack
 		if controllerutil.ContainsFinalizer(o, finalizer) {
+			if st, ok := c.updates.Status(destroyKey); ok {
+				switch st.Phase {
+				case update.PhaseRunning:
+					log.Info("destroy already in progress", "stack", s.Name())
+					return ctrl.Result{}, nil
+				case update.PhaseSucceeded:
+					c.updates.Clear(destroyKey)
+					c.clearDestroyAttempts(destroyKey)
+					log.Info("successfully destroyed stack", s.Name(), st.Log)
+
+					if sink, ok := o.(SecretSinkObj); ok {
+						if ref := sink.GetSecretOutputSink(); ref != nil {
+							if err := deleteSecretOutputSink(ctx, r, o, ref); err != nil {
+								log.Error(err, "failed to remove secret output sink")
+								return ctrl.Result{}, err
+							}
+						}
+					}
+
+					if fso, ok := o.(FinalizerStatusObj); ok {
+						fso.SetFinalizingStatus(nil)
+					}
+
+					return c.removeFinalizer(ctx, o, r, finalizer,
+						fmt.Sprintf("Finalizer operations for custom resource %s name were successfully accomplished", o.GetName()))
+				case update.PhaseFailed:
+					c.updates.Clear(destroyKey)
+					log.Error(st.Err, "failed to destroy stack")
+
+					attempts := c.nextDestroyAttempt(destroyKey)
+
+					if o.GetAnnotations()[ForceDeleteAnnotation] == "true" {
+						log.Info("force-delete annotation set, removing finalizer despite failed destroy", "stack", s.Name())
+
+						c.clearDestroyAttempts(destroyKey)
+						if fso, ok := o.(FinalizerStatusObj); ok {
+							fso.SetFinalizingStatus(&FinalizingStatus{
+								Attempts:     attempts,
+								LastError:    st.Err.Error(),
+								Log:          st.Log,
+								OrphanedURNs: orphanedURNs(ctx, s),
+							})
+						}
+
+						return c.removeFinalizer(ctx, o, r, finalizer,
+							"Finalizer removed via force-delete after a failed destroy; see status for orphaned resources")
+					}
+
+					if fso, ok := o.(FinalizerStatusObj); ok {
+						fso.SetFinalizingStatus(&FinalizingStatus{
+							Attempts:         attempts,
+							LastError:        st.Err.Error(),
+							OperationSummary: st.ChangeSummary,
+							Log:              st.Log,
+						})
+					}
+
+					backoff := c.destroyBackoff(attempts)
+					if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Finalizing",
+						fmt.Sprintf("Destroy attempt %d failed: %s; retrying in %s", attempts, st.Err, backoff)); err != nil {
+						log.Error(err, "Failed to update Object status")
+						return ctrl.Result{}, err
+					}
+					return ctrl.Result{RequeueAfter: backoff}, nil
+				}
+				return ctrl.Result{}, nil
+			}
+
+			// An Up for this object may still be running under its own key;
+			// let it finish before starting a Destroy against the same
+			// stack rather than racing the two against each other.
+			if st, ok := c.updates.Status(upKey); ok {
+				if st.Phase == update.PhaseRunning {
+					log.Info("waiting for in-progress update before destroying stack", "stack", s.Name())
+					return ctrl.Result{}, nil
+				}
+				c.updates.Clear(upKey)
+			}
+
 			log.Info("Performing Finalizer Operations for Object before delete CR")
 
 			// Set the Ready condition to "False" to reflect that this resource began its process to be terminated.
@@ -104,32 +391,54 @@ func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (c
 				return ctrl.Result{}, err
 			}
 
-			// Delete the stack
-			outBuf := new(bytes.Buffer)
-			_, err := s.Destroy(ctx, optdestroy.ProgressStreams(outBuf))
-			if err != nil {
-				log.Error(err, "Failed to destroy stack")
-				return ctrl.Result{}, nil
-			}
-			log.Info("successfully destroyed stack", s.Name(), outBuf.String())
+			// Kick off the destroy in the background; we'll be re-reconciled
+			// via Events() once it completes.
+			c.updates.Start(destroyKey, s, nil, o)
+		}
+		return ctrl.Result{}, nil
+	}
 
-			if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Finalizing", fmt.Sprintf("Finalizer operations for custom resource %s name were successfully accomplished", o.GetName())); err != nil {
+	// Pick up the result of a previously started Up, if any.
+	if st, ok := c.updates.Status(upKey); ok {
+		switch st.Phase {
+		case update.PhaseRunning:
+			log.Info("update already in progress", "stack", s.Name())
+			return ctrl.Result{}, nil
+		case update.PhaseFailed:
+			c.updates.Clear(upKey)
+			log.Error(st.Err, "failed to deploy stack", s.Name(), st.Log)
+			if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Failed", st.Err.Error()); err != nil {
 				log.Error(err, "Failed to update Object status")
-				return ctrl.Result{}, err
 			}
+			return ctrl.Result{}, st.Err
+		case update.PhaseSucceeded:
+			c.updates.Clear(upKey)
+			log.Info("successfully deployed/updated stack", s.Name(), st.Log)
 
-			log.Info("Removing Finalizer for Object after successfully perform the operations")
-			if ok := controllerutil.RemoveFinalizer(o, finalizer); !ok {
-				log.Error(err, "Failed to remove finalizer for Object")
-				return ctrl.Result{Requeue: true}, nil
+			statusOutputs := st.Outputs
+			if sink, ok := o.(SecretSinkObj); ok {
+				if ref := sink.GetSecretOutputSink(); ref != nil {
+					if err := projectSecretOutputs(ctx, r, o, ref, st.Outputs); err != nil {
+						log.Error(err, "failed to project secret outputs")
+						return ctrl.Result{}, err
+					}
+					statusOutputs = nonSecretOutputs(st.Outputs)
+				}
 			}
 
-			if err := r.Update(ctx, o); err != nil {
-				log.Error(err, "Failed to remove finalizer for Object")
+			o.SetStatus(statusOutputs)
+			if err := r.Status().Update(ctx, o); err != nil {
+				log.Error(err, "Failed to update Object status")
+				return ctrl.Result{}, err
+			}
+
+			// Set the Ready condtion to "True" to reflect that this resource is created.
+			if err := setReadyStatus(ctx, metav1.ConditionTrue, o, r, "Created", "The Object was successfully created"); err != nil {
+				log.Error(err, "Failed to update Object status")
 				return ctrl.Result{}, err
 			}
+			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, nil
 	}
 
 	// Check if there are any changes to be applied
@@ -152,36 +461,120 @@ func Reconcile(ctx context.Context, o Obj, req ctrl.Request, r client.Client) (c
 	}
 	log.Info("detected changes to apply", "stack", s.Name())
 	// Set the Ready condition to "False" to reflect that this resource is being reconciled.
-	if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Reconciling", "Starting reconciliation"); err != nil {
+	if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Updating", "Applying pending Pulumi changes"); err != nil {
 		log.Error(err, "Failed to update Object status")
 		return ctrl.Result{}, err
 	}
 
-	// Create or update the stack
-	// we'll write all of the update logs to a buffer
-	outBuf := new(bytes.Buffer)
-	upRes, err := s.Up(ctx, optup.ProgressStreams(outBuf))
-	if err != nil {
-		log.Error(err, "failed to deploy stack", s.Name(), outBuf.String())
-		return ctrl.Result{}, err
-	}
-	log.Info("successfully deployed/updated stack", s.Name(), outBuf.String())
+	// Kick off the update in the background; we'll be re-reconciled via
+	// Events() once it completes, rather than blocking here for the
+	// duration of the Pulumi operation.
+	c.updates.Start(upKey, s, p.ChangeSummary, o)
+
+	return ctrl.Result{}, nil
+}
 
-	o.SetStatus(upRes.Outputs)
-	if err = r.Status().Update(ctx, o); err != nil {
+// removeFinalizer sets the Ready condition to message, removes finalizer
+// from o, and persists both.
+func (c *Controller) removeFinalizer(ctx context.Context, o Obj, r client.Client, finalizer, message string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	if err := setReadyStatus(ctx, metav1.ConditionFalse, o, r, "Finalizing", message); err != nil {
 		log.Error(err, "Failed to update Object status")
 		return ctrl.Result{}, err
 	}
 
-	// Set the Ready condtion to "True" to reflect that this resource is created.
-	if err := setReadyStatus(ctx, metav1.ConditionTrue, o, r, "Created", "The Object was successfully created"); err != nil {
-		log.Error(err, "Failed to update Object status")
+	log.Info("Removing Finalizer for Object after successfully perform the operations")
+	if ok := controllerutil.RemoveFinalizer(o, finalizer); !ok {
+		log.Error(nil, "Failed to remove finalizer for Object")
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	if err := r.Update(ctx, o); err != nil {
+		log.Error(err, "Failed to remove finalizer for Object")
 		return ctrl.Result{}, err
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// orphanedURNs best-effort exports s's current state and returns the URNs
+// of any resources still recorded in it, for audit after a force-delete.
+func orphanedURNs(ctx context.Context, s *auto.Stack) []string {
+	dep, err := s.Export(ctx)
+	if err != nil {
+		return nil
+	}
+
+	var deployment struct {
+		Resources []struct {
+			URN string `json:"urn"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(dep.Deployment, &deployment); err != nil {
+		return nil
+	}
+
+	urns := make([]string, 0, len(deployment.Resources))
+	for _, res := range deployment.Resources {
+		urns = append(urns, res.URN)
+	}
+	return urns
+}
+
+// nonSecretOutputs returns the subset of outputs Pulumi hasn't marked secret.
+func nonSecretOutputs(outputs auto.OutputMap) auto.OutputMap {
+	out := make(auto.OutputMap, len(outputs))
+	for k, v := range outputs {
+		if !v.Secret {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// projectSecretOutputs writes the outputs Pulumi marked secret into ref,
+// creating or updating the Secret with an owner reference back to o.
+func projectSecretOutputs(ctx context.Context, r client.Client, o Obj, ref *corev1.SecretReference, outputs auto.OutputMap) error {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = o.GetNamespace()
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: namespace}}
+	_, err := controllerutil.CreateOrUpdate(ctx, r, secret, func() error {
+		data := make(map[string][]byte, len(outputs))
+		for key, out := range outputs {
+			if !out.Secret {
+				continue
+			}
+			data[key] = []byte(fmt.Sprintf("%v", out.Value))
+		}
+		secret.Data = data
+		secret.Type = corev1.SecretTypeOpaque
+
+		return controllerutil.SetControllerReference(o, secret, r.Scheme())
+	})
+
+	return err
+}
+
+// deleteSecretOutputSink removes the Secret outputs were projected into, if
+// it exists.
+func deleteSecretOutputSink(ctx context.Context, r client.Client, o Obj, ref *corev1.SecretReference) error {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = o.GetNamespace()
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: namespace}}
+	if err := r.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
 func setReadyStatus(ctx context.Context, status metav1.ConditionStatus, o Obj, r client.Client, resason, message string) error {
 	if changed := meta.SetStatusCondition(o.GetStatusConditions(), metav1.Condition{
 		Type:    conditionTypeReady,
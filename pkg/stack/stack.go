@@ -2,6 +2,8 @@ package stack
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/pkg/errors"
 
@@ -9,48 +11,304 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SecretsProviderKind selects which Pulumi secrets provider a stack uses.
+type SecretsProviderKind string
+
+const (
+	SecretsProviderPassphrase    SecretsProviderKind = "passphrase"
+	SecretsProviderAWSKMS        SecretsProviderKind = "awskms"
+	SecretsProviderAzureKeyVault SecretsProviderKind = "azurekeyvault"
+	SecretsProviderGCPKMS        SecretsProviderKind = "gcpkms"
+	SecretsProviderHashiVault    SecretsProviderKind = "hashivault"
+)
+
+// SecretKeyRef points at a single key within a Kubernetes Secret.
+type SecretKeyRef struct {
+	Name      string
+	Namespace string
+	Key       string
+}
+
+// Options configures the Pulumi backend, secrets provider, and project
+// settings used by GetStack. Consumers register an Options value per CR
+// kind via Register so the library isn't tied to any one backend/account.
+type Options struct {
+	// BackendURL is the Pulumi state backend, e.g. "s3://my-bucket",
+	// "azblob://state", or "https://app.pulumi.com".
+	BackendURL string
+
+	// SecretsProviderKind selects the secrets provider configured for the
+	// stack. Defaults to SecretsProviderPassphrase when empty.
+	SecretsProviderKind SecretsProviderKind
+
+	// SecretsProviderConfig is the provider-specific suffix appended after
+	// "<kind>://", e.g. a KMS key alias/ARN for awskms/azurekeyvault/gcpkms,
+	// or a key name for hashivault. Unused for the passphrase provider.
+	SecretsProviderConfig string
+
+	// PassphraseSecretRef points at the Kubernetes Secret (and key within
+	// it) holding PULUMI_CONFIG_PASSPHRASE. Required when
+	// SecretsProviderKind is SecretsProviderPassphrase.
+	PassphraseSecretRef *SecretKeyRef
+
+	// EnvVars are additional environment variables passed to the Pulumi
+	// workspace, e.g. cloud provider credentials.
+	EnvVars map[string]string
+
+	// StackConfig is the Pulumi stack config applied after the stack is
+	// created, e.g. {"aws:region": auto.ConfigValue{Value: "us-west-2"}}.
+	StackConfig map[string]auto.ConfigValue
+
+	// ProjectName overrides the Pulumi project name. Defaults to kind.
+	ProjectName string
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Options{}
 )
 
-func GetStack(ctx context.Context, program pulumi.RunFunc, kind, name, namespace string) (*auto.Stack, error) {
+// Register associates Options with a CR kind (as returned by
+// strings.ToLower(obj.GetObjectKind().GroupVersionKind().Kind)). Controllers
+// built on controller.Reconcile call this once, typically from their
+// SetupWithManager, so GetStack knows how to build stacks for that kind.
+// Register and GetStack/GetRemoteStack are safe to call concurrently.
+func Register(kind string, opts Options) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[kind] = opts
+}
+
+func optionsFor(kind string) (Options, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	opts, ok := registry[kind]
+	return opts, ok
+}
+
+func GetStack(ctx context.Context, r client.Client, program pulumi.RunFunc, kind, name, namespace string) (*auto.Stack, error) {
 	stackName := namespace + "-" + name
 
+	projectName, workspaceOpts, err := commonWorkspaceOpts(ctx, r, kind, stackName)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := auto.UpsertStackInlineSource(ctx, stackName, projectName, program, workspaceOpts...)
+	if err != nil {
+		// TODO: handle different error types
+		return nil, errors.Wrapf(err, "failed to create stack %s", stackName)
+	}
+
+	return applyStackConfig(ctx, s, kind)
+}
+
+// GetRemoteStack is like GetStack, but builds the stack from a Pulumi
+// program hosted in a Git repository instead of one compiled into the
+// operator binary.
+func GetRemoteStack(ctx context.Context, r client.Client, src *GitSource, kind, name, namespace string) (*auto.Stack, error) {
+	stackName := namespace + "-" + name
+
+	_, workspaceOpts, err := commonWorkspaceOpts(ctx, r, kind, stackName)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := gitRepo(ctx, r, src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve git source for stack %s", stackName)
+	}
+
+	s, err := auto.UpsertStackRemoteSource(ctx, stackName, repo, workspaceOpts...)
+	if err != nil {
+		// TODO: handle different error types
+		return nil, errors.Wrapf(err, "failed to create stack %s", stackName)
+	}
+
+	return applyStackConfig(ctx, s, kind)
+}
+
+// commonWorkspaceOpts builds the LocalWorkspaceOptions shared by inline and
+// remote stack sources: project/backend settings, the secrets provider, and
+// environment variables.
+func commonWorkspaceOpts(ctx context.Context, r client.Client, kind, stackName string) (string, []auto.LocalWorkspaceOption, error) {
+	opts, ok := optionsFor(kind)
+	if !ok {
+		return "", nil, errors.Errorf("no stack options registered for kind %q", kind)
+	}
+
+	projectName := opts.ProjectName
+	if projectName == "" {
+		projectName = kind
+	}
+
 	project := auto.Project(workspace.Project{
-		Name:    tokens.PackageName(kind),
+		Name:    tokens.PackageName(projectName),
 		Runtime: workspace.NewProjectRuntimeInfo("go", nil),
 		Backend: &workspace.ProjectBackend{
-			URL: "s3://acme-cloud-backend",
+			URL: opts.BackendURL,
 		},
 	})
 
-	// Setup a passphrase secrets provider and use an environment variable to pass in the passphrase.
-	secretsProvider := auto.SecretsProvider("passphrase")
-	envvars := auto.EnvVars(map[string]string{
-		// In a real program, you would feed in the password securely or via the actual environment.
-		"PULUMI_CONFIG_PASSPHRASE": "password",
-	})
+	providerKind := opts.SecretsProviderKind
+	if providerKind == "" {
+		providerKind = SecretsProviderPassphrase
+	}
+
+	envvars := make(map[string]string, len(opts.EnvVars)+1)
+	for k, v := range opts.EnvVars {
+		envvars[k] = v
+	}
+
+	if providerKind == SecretsProviderPassphrase {
+		passphrase, err := resolvePassphrase(ctx, r, opts.PassphraseSecretRef)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "failed to resolve passphrase for stack %s", stackName)
+		}
+		envvars["PULUMI_CONFIG_PASSPHRASE"] = passphrase
+	}
+
+	secretsProviderURL := string(providerKind)
+	if providerKind != SecretsProviderPassphrase && opts.SecretsProviderConfig != "" {
+		secretsProviderURL += "://" + opts.SecretsProviderConfig
+	}
 
 	stackSettings := auto.Stacks(map[string]workspace.ProjectStack{
-		stackName: {SecretsProvider: "passphrase"},
+		stackName: {SecretsProvider: secretsProviderURL},
 	})
 
-	s, err := auto.UpsertStackInlineSource(
-		ctx,
-		stackName,
-		kind,
-		program,
+	return projectName, []auto.LocalWorkspaceOption{
 		project,
-		secretsProvider,
+		auto.SecretsProvider(secretsProviderURL),
 		stackSettings,
-		envvars,
-	)
-	if err != nil {
-		// TODO: handle different error types
-		return nil, errors.Wrapf(err, "failed to create stack %s", stackName)
-	}
+		auto.EnvVars(envvars),
+	}, nil
+}
 
-	if err := s.SetConfig(ctx, "aws:region", auto.ConfigValue{Value: "us-west-2"}); err != nil {
-		return nil, errors.Wrap(err, "failed to set pulumi config")
+func applyStackConfig(ctx context.Context, s auto.Stack, kind string) (*auto.Stack, error) {
+	opts, _ := optionsFor(kind)
+	for key, value := range opts.StackConfig {
+		if err := s.SetConfig(ctx, key, value); err != nil {
+			return nil, errors.Wrap(err, "failed to set pulumi config")
+		}
 	}
 
 	return &s, nil
 }
+
+// GitSource describes a Pulumi program hosted in a Git repository, for use
+// with GetRemoteStack instead of an inline program compiled into the
+// operator binary.
+type GitSource struct {
+	// URL is the Git repository URL, e.g. "https://github.com/org/repo".
+	URL string
+
+	// Branch is the branch to check out, e.g. "refs/heads/main". Mutually
+	// exclusive with CommitHash.
+	Branch string
+
+	// CommitHash is the commit to check out. Mutually exclusive with Branch.
+	CommitHash string
+
+	// ProjectPath is the subdirectory within the repo containing the
+	// Pulumi project (the directory with Pulumi.yaml). Optional; defaults
+	// to the repo root.
+	ProjectPath string
+
+	// Auth, if set, supplies credentials for a private repository.
+	Auth *GitAuth
+}
+
+// GitAuth references the Kubernetes Secrets holding credentials for a
+// private Git repository. At most one of the credential pairs should be
+// set; SSHPrivateKeySecretRef takes precedence if multiple are.
+type GitAuth struct {
+	// SSHPrivateKeySecretRef references a Secret key holding an SSH private key.
+	SSHPrivateKeySecretRef *SecretKeyRef
+
+	// PersonalAccessTokenSecretRef references a Secret key holding a personal access token.
+	PersonalAccessTokenSecretRef *SecretKeyRef
+
+	// UsernameSecretRef and PasswordSecretRef reference Secret keys holding
+	// basic auth credentials.
+	UsernameSecretRef *SecretKeyRef
+	PasswordSecretRef *SecretKeyRef
+}
+
+func gitRepo(ctx context.Context, r client.Client, src *GitSource) (auto.GitRepo, error) {
+	if src == nil {
+		return auto.GitRepo{}, errors.New("git source is required")
+	}
+
+	repo := auto.GitRepo{
+		URL:         src.URL,
+		Branch:      src.Branch,
+		CommitHash:  src.CommitHash,
+		ProjectPath: src.ProjectPath,
+	}
+
+	if src.Auth == nil {
+		return repo, nil
+	}
+
+	auth := &auto.GitAuth{}
+	switch {
+	case src.Auth.SSHPrivateKeySecretRef != nil:
+		key, err := resolveSecretKey(ctx, r, src.Auth.SSHPrivateKeySecretRef)
+		if err != nil {
+			return auto.GitRepo{}, errors.Wrap(err, "failed to resolve ssh private key")
+		}
+		auth.SSHPrivateKey = key
+	case src.Auth.PersonalAccessTokenSecretRef != nil:
+		token, err := resolveSecretKey(ctx, r, src.Auth.PersonalAccessTokenSecretRef)
+		if err != nil {
+			return auto.GitRepo{}, errors.Wrap(err, "failed to resolve personal access token")
+		}
+		auth.PersonalAccessToken = token
+	case src.Auth.UsernameSecretRef != nil || src.Auth.PasswordSecretRef != nil:
+		username, err := resolveSecretKey(ctx, r, src.Auth.UsernameSecretRef)
+		if err != nil {
+			return auto.GitRepo{}, errors.Wrap(err, "failed to resolve git username")
+		}
+		password, err := resolveSecretKey(ctx, r, src.Auth.PasswordSecretRef)
+		if err != nil {
+			return auto.GitRepo{}, errors.Wrap(err, "failed to resolve git password")
+		}
+		auth.Username = username
+		auth.Password = password
+	}
+	repo.Auth = auth
+
+	return repo, nil
+}
+
+func resolveSecretKey(ctx context.Context, r client.Client, ref *SecretKeyRef) (string, error) {
+	if ref == nil {
+		return "", errors.New("secret reference is required")
+	}
+
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Name: ref.Name, Namespace: ref.Namespace}, secret); err != nil {
+		return "", errors.Wrapf(err, "failed to get secret %s/%s", ref.Namespace, ref.Name)
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %q", ref.Namespace, ref.Name, ref.Key)
+	}
+
+	return string(value), nil
+}
+
+func resolvePassphrase(ctx context.Context, r client.Client, ref *SecretKeyRef) (string, error) {
+	if ref == nil {
+		return "", errors.New("passphrase secrets provider requires a PassphraseSecretRef")
+	}
+
+	return resolveSecretKey(ctx, r, ref)
+}
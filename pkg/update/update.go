@@ -0,0 +1,223 @@
+// Package update runs a single Pulumi Up/Destroy operation off the
+// reconcile goroutine and reports its progress and outcome back to the
+// caller. A real Pulumi update can run for many minutes; holding the
+// reconcile worker for that long starves other objects and races the
+// controller-runtime cache, the same problem the Pulumi Kubernetes
+// Operator solved by splitting its Stack/Workspace/Update controllers.
+//
+// Manager is the in-memory analogue of that split: it tracks at most one
+// in-flight operation per object and operation (see Key) and emits a GenericEvent on completion so
+// the owning controller can re-reconcile and pick up the result.
+package update
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// Operation is the Pulumi operation an Update runs.
+type Operation string
+
+const (
+	OperationUp      Operation = "Up"
+	OperationDestroy Operation = "Destroy"
+)
+
+// Phase is the lifecycle state of an in-flight or completed Update.
+type Phase string
+
+const (
+	PhaseRunning   Phase = "Running"
+	PhaseSucceeded Phase = "Succeeded"
+	PhaseFailed    Phase = "Failed"
+)
+
+// Status reports the progress and outcome of an Update.
+type Status struct {
+	Phase Phase
+
+	// ChangeSummary mirrors the Preview result that triggered this Update,
+	// so callers can surface pending operation counts without tailing logs.
+	// For an OperationDestroy it is replaced, once the Destroy returns, by
+	// the resource changes that Destroy reported, when it reported any.
+	ChangeSummary map[apitype.OpType]int
+
+	// Outputs holds the stack outputs once an OperationUp succeeds.
+	Outputs auto.OutputMap
+
+	// Err is set when Phase is PhaseFailed.
+	Err error
+
+	// Log holds up to maxLogBytes of the Pulumi progress stream captured
+	// while the operation ran, so it's safe to persist into a CR status
+	// subresource even for a long-running Up/Destroy.
+	Log string
+}
+
+// maxLogBytes bounds Status.Log. A Destroy that's stuck retrying can run
+// for a long time and produce far more progress output than is useful, or
+// safe, to write wholesale into a Kubernetes status subresource.
+const maxLogBytes = 16 * 1024
+
+// ringBuffer is an io.Writer that retains only the last maxLogBytes bytes
+// written to it.
+type ringBuffer struct {
+	buf []byte
+}
+
+func (w *ringBuffer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > maxLogBytes {
+		w.buf = w.buf[len(w.buf)-maxLogBytes:]
+	}
+	return len(p), nil
+}
+
+func (w *ringBuffer) String() string {
+	return string(w.buf)
+}
+
+// Key identifies the Update work item for one object and operation. Kind
+// is included because a Manager is shared across every CR kind a
+// controller binary reconciles, and name/namespace alone aren't unique
+// across kinds. Operation is included so an Up and a Destroy started for
+// the same object never alias the same work item; without it, a Destroy
+// started after an Up completes (or vice versa) would read back the
+// other operation's stale status.
+type Key struct {
+	Kind      string
+	Operation Operation
+	types.NamespacedName
+}
+
+// NewKey builds a Key for the given kind, operation, and object.
+func NewKey(kind string, op Operation, name types.NamespacedName) Key {
+	return Key{Kind: kind, Operation: op, NamespacedName: name}
+}
+
+// Manager tracks at most one in-flight Update per Key and runs its
+// s.Up/s.Destroy call on its own goroutine.
+type Manager struct {
+	events chan event.GenericEvent
+
+	mu   sync.Mutex
+	work map[Key]*Status
+}
+
+// NewManager creates a Manager. Wire Events into the owning controller's
+// SetupWithManager (e.g. via WatchesRawSource(source.Channel(...))) so a
+// completed Update re-triggers Reconcile for its object.
+func NewManager() *Manager {
+	return &Manager{
+		events: make(chan event.GenericEvent),
+		work:   make(map[Key]*Status),
+	}
+}
+
+// Events returns the channel of GenericEvents emitted when an Update for
+// that event's object completes.
+func (m *Manager) Events() <-chan event.GenericEvent {
+	return m.events
+}
+
+// Status returns the current status of the in-flight or last-completed
+// Update for key, if any.
+func (m *Manager) Status(key Key) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.work[key]
+	if !ok {
+		return Status{}, false
+	}
+	return *st, true
+}
+
+// Clear drops the recorded status for key, e.g. once the caller has
+// consumed a completed Update's result.
+func (m *Manager) Clear(key Key) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.work, key)
+}
+
+// Start launches key.Operation against s on its own goroutine unless key
+// already has an Update running, and returns the (possibly just-created)
+// status. obj is deep-copied and used as the GenericEvent object
+// re-enqueued on completion.
+func (m *Manager) Start(key Key, s *auto.Stack, changeSummary map[apitype.OpType]int, obj client.Object) Status {
+	m.mu.Lock()
+	if st, ok := m.work[key]; ok && st.Phase == PhaseRunning {
+		m.mu.Unlock()
+		return *st
+	}
+	st := &Status{Phase: PhaseRunning, ChangeSummary: changeSummary}
+	m.work[key] = st
+	m.mu.Unlock()
+
+	go m.run(key.Operation, s, obj.DeepCopyObject().(client.Object), st)
+
+	return *st
+}
+
+func (m *Manager) run(op Operation, s *auto.Stack, obj client.Object, st *Status) {
+	ctx := context.Background()
+	outBuf := &ringBuffer{}
+
+	var outputs auto.OutputMap
+	// destroySummary is nil for OperationUp: Start already seeded
+	// st.ChangeSummary from the Preview that triggered the Up, and that's
+	// the value Status documents as ChangeSummary's meaning.
+	var destroySummary map[apitype.OpType]int
+	var err error
+	switch op {
+	case OperationUp:
+		var res auto.UpResult
+		res, err = s.Up(ctx, optup.ProgressStreams(outBuf))
+		outputs = res.Outputs
+	case OperationDestroy:
+		var res auto.DestroyResult
+		res, err = s.Destroy(ctx, optdestroy.ProgressStreams(outBuf))
+		destroySummary = resourceChanges(res.Summary.ResourceChanges)
+	}
+
+	m.mu.Lock()
+	st.Log = outBuf.String()
+	if err != nil {
+		st.Phase = PhaseFailed
+		st.Err = err
+	} else {
+		st.Phase = PhaseSucceeded
+		st.Outputs = outputs
+	}
+	if destroySummary != nil {
+		st.ChangeSummary = destroySummary
+	}
+	m.mu.Unlock()
+
+	m.events <- event.GenericEvent{Object: obj}
+}
+
+// resourceChanges converts a Pulumi UpdateSummary's ResourceChanges (string
+// op-type keys, e.g. from Stack.Destroy) into the apitype.OpType-keyed form
+// Stack.Preview's ChangeSummary already uses, so callers can treat either
+// the same way.
+func resourceChanges(changes *map[string]int) map[apitype.OpType]int {
+	if changes == nil {
+		return nil
+	}
+
+	out := make(map[apitype.OpType]int, len(*changes))
+	for op, count := range *changes {
+		out[apitype.OpType(op)] = count
+	}
+	return out
+}